@@ -0,0 +1,86 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package backend implements the Redis-backed routes store Router and
+// FastRouter use to resolve a frontend host to its backends and to mark
+// backends dead or alive as requests and health checks observe them.
+package backend
+
+import (
+	"time"
+
+	"github.com/tsuru/planb/healthcheck"
+)
+
+// RoutesBackend is the interface Router and FastRouter depend on to stay
+// decoupled from the routes store's storage details. RedisBackend is the
+// only production implementation; tests supply their own stub.
+type RoutesBackend interface {
+	// Backends returns, for host: an opaque key identifying this
+	// frontend's backend set (used to group log entries), the backend
+	// URLs themselves, the set of currently-dead backend indexes, and
+	// whether cookie-based sticky sessions are enabled for this
+	// frontend.
+	Backends(host string) (backendKey string, backends []string, dead map[int]struct{}, sticky bool, err error)
+
+	// MarkDead records that backend (identified by its position,
+	// backendIdx, in a backendLen-long list) failed a request or health
+	// check, for ttl seconds.
+	MarkDead(host, backend string, backendIdx, backendLen int, ttl int) error
+
+	// MarkAlive records that backend, previously marked dead, passed a
+	// health check and should be returned to rotation immediately
+	// instead of waiting for its dead TTL to expire.
+	MarkAlive(host, backend string, backendIdx, backendLen int) error
+
+	// BreakerConfig returns the circuit breaker configuration for host.
+	// ok is false when host has no breaker configured, in which case
+	// Router runs it without one.
+	BreakerConfig(host string) (config BreakerConfig, ok bool, err error)
+
+	// RateLimitConfig returns the rate limit configuration for host. ok
+	// is false when host has no rate limit configured, in which case
+	// Router runs it unlimited.
+	RateLimitConfig(host string) (config RateLimitConfig, ok bool, err error)
+
+	// HealthCheckConfig returns the active health check policy for
+	// host. ok is false when host has no health check configured, in
+	// which case Router never actively probes its backends.
+	HealthCheckConfig(host string) (config healthcheck.Config, ok bool, err error)
+
+	// AllFrontends returns every host currently known to the routes
+	// store, for the active health checker to enumerate probe targets.
+	AllFrontends() ([]string, error)
+}
+
+// RateLimitKeySource selects what a rate-limit bucket key is derived from.
+type RateLimitKeySource int
+
+const (
+	RateLimitKeyIP RateLimitKeySource = iota
+	RateLimitKeyHeader
+	RateLimitKeyIPAndHeader
+)
+
+// RateLimitConfig is the per-frontend rate limit configuration, read from
+// the routes backend.
+type RateLimitConfig struct {
+	Rate              float64
+	Burst             float64
+	KeySource         RateLimitKeySource
+	HeaderName        string
+	TrustForwardedFor bool
+}
+
+// BreakerConfig is the per-frontend circuit breaker configuration, read
+// from the routes backend.
+type BreakerConfig struct {
+	Predicate          string
+	FallbackStatusCode int
+	FallbackBody       []byte
+	FallbackHeaders    map[string]string
+	FallbackURL        string
+	TrippedFor         time.Duration
+	RecoverFor         time.Duration
+}
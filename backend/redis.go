@@ -0,0 +1,258 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/tsuru/planb/healthcheck"
+)
+
+// RedisOptions configures a connection pool to either the read or the
+// write Redis used by RedisBackend. Router keeps the two separate so
+// reads (on the request hot path) can be pointed at a replica while
+// writes (marking a backend dead) go to the primary.
+type RedisOptions struct {
+	Host     string
+	Port     int
+	Password string
+	Database int
+	PoolSize int
+}
+
+func (o RedisOptions) addr() string {
+	host := o.Host
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	port := o.Port
+	if port == 0 {
+		port = 6379
+	}
+	return fmt.Sprintf("%s:%d", host, port)
+}
+
+func (o RedisOptions) pool() *redis.Pool {
+	size := o.PoolSize
+	if size == 0 {
+		size = 20
+	}
+	return &redis.Pool{
+		MaxIdle:     size,
+		IdleTimeout: 240 * time.Second,
+		Dial: func() (redis.Conn, error) {
+			conn, err := redis.Dial("tcp", o.addr())
+			if err != nil {
+				return nil, err
+			}
+			if o.Password != "" {
+				if _, err = conn.Do("AUTH", o.Password); err != nil {
+					conn.Close()
+					return nil, err
+				}
+			}
+			if o.Database != 0 {
+				if _, err = conn.Do("SELECT", o.Database); err != nil {
+					conn.Close()
+					return nil, err
+				}
+			}
+			return conn, nil
+		},
+	}
+}
+
+// RedisBackend is the production RoutesBackend, storing every frontend's
+// configuration and backend list in Redis under keys namespaced by host:
+//
+//	frontend:<host>       LIST of backend URLs
+//	frontend:<host>:dead  HASH backendIdx -> unix expiry, one field per
+//	                      currently-dead backend
+//	frontend:<host>:sticky STRING "1" when cookie-based affinity is on
+type RedisBackend struct {
+	read  *redis.Pool
+	write *redis.Pool
+}
+
+// NewRedisBackend creates a RedisBackend reading through readOpts and
+// writing (marking backends dead/alive) through writeOpts.
+func NewRedisBackend(readOpts, writeOpts RedisOptions) (*RedisBackend, error) {
+	return &RedisBackend{read: readOpts.pool(), write: writeOpts.pool()}, nil
+}
+
+func frontendKey(host string) string          { return "frontend:" + host }
+func frontendDeadKey(host string) string      { return "frontend:" + host + ":dead" }
+func frontendStickyKey(host string) string    { return "frontend:" + host + ":sticky" }
+func frontendBreakerKey(host string) string   { return "frontend:" + host + ":breaker" }
+func frontendRateLimitKey(host string) string { return "frontend:" + host + ":ratelimit" }
+func frontendHealthKey(host string) string    { return "frontend:" + host + ":healthcheck" }
+
+const frontendsKey = "frontends"
+
+func (b *RedisBackend) Backends(host string) (string, []string, map[int]struct{}, bool, error) {
+	conn := b.read.Get()
+	defer conn.Close()
+	backends, err := redis.Strings(conn.Do("LRANGE", frontendKey(host), 0, -1))
+	if err != nil && err != redis.ErrNil {
+		return "", nil, nil, false, fmt.Errorf("error fetching backends for %s: %s", host, err)
+	}
+	deadFields, err := redis.StringMap(conn.Do("HGETALL", frontendDeadKey(host)))
+	if err != nil && err != redis.ErrNil {
+		return "", nil, nil, false, fmt.Errorf("error fetching dead backends for %s: %s", host, err)
+	}
+	now := time.Now().Unix()
+	dead := make(map[int]struct{}, len(deadFields))
+	for idxStr, expiresStr := range deadFields {
+		var idx int
+		var expires int64
+		if _, err := fmt.Sscanf(idxStr, "%d", &idx); err != nil {
+			continue
+		}
+		if _, err := fmt.Sscanf(expiresStr, "%d", &expires); err != nil {
+			continue
+		}
+		if expires > now {
+			dead[idx] = struct{}{}
+		}
+	}
+	sticky, err := redis.Bool(conn.Do("GET", frontendStickyKey(host)))
+	if err != nil && err != redis.ErrNil {
+		return "", nil, nil, false, fmt.Errorf("error fetching sticky flag for %s: %s", host, err)
+	}
+	return host, backends, dead, sticky, nil
+}
+
+// BreakerConfig reads the per-frontend circuit breaker configuration from
+// the frontend:<host>:breaker hash. ok is false when the hash doesn't
+// exist, meaning host has no breaker configured.
+func (b *RedisBackend) BreakerConfig(host string) (BreakerConfig, bool, error) {
+	conn := b.read.Get()
+	defer conn.Close()
+	fields, err := redis.StringMap(conn.Do("HGETALL", frontendBreakerKey(host)))
+	if err != nil && err != redis.ErrNil {
+		return BreakerConfig{}, false, fmt.Errorf("error fetching breaker config for %s: %s", host, err)
+	}
+	if len(fields) == 0 {
+		return BreakerConfig{}, false, nil
+	}
+	config := BreakerConfig{
+		Predicate:    fields["predicate"],
+		FallbackBody: []byte(fields["fallback_body"]),
+		FallbackURL:  fields["fallback_url"],
+	}
+	if code, err := strconv.Atoi(fields["fallback_status_code"]); err == nil {
+		config.FallbackStatusCode = code
+	}
+	if secs, err := strconv.Atoi(fields["tripped_for_seconds"]); err == nil {
+		config.TrippedFor = time.Duration(secs) * time.Second
+	}
+	if secs, err := strconv.Atoi(fields["recover_for_seconds"]); err == nil {
+		config.RecoverFor = time.Duration(secs) * time.Second
+	}
+	return config, true, nil
+}
+
+// RateLimitConfig reads the per-frontend rate limit configuration from
+// the frontend:<host>:ratelimit hash. ok is false when the hash doesn't
+// exist, meaning host has no rate limit configured.
+func (b *RedisBackend) RateLimitConfig(host string) (RateLimitConfig, bool, error) {
+	conn := b.read.Get()
+	defer conn.Close()
+	fields, err := redis.StringMap(conn.Do("HGETALL", frontendRateLimitKey(host)))
+	if err != nil && err != redis.ErrNil {
+		return RateLimitConfig{}, false, fmt.Errorf("error fetching rate limit config for %s: %s", host, err)
+	}
+	if len(fields) == 0 {
+		return RateLimitConfig{}, false, nil
+	}
+	config := RateLimitConfig{
+		HeaderName:        fields["header_name"],
+		TrustForwardedFor: fields["trust_forwarded_for"] == "1",
+	}
+	if rate, err := strconv.ParseFloat(fields["rate"], 64); err == nil {
+		config.Rate = rate
+	}
+	if burst, err := strconv.ParseFloat(fields["burst"], 64); err == nil {
+		config.Burst = burst
+	}
+	switch fields["key_source"] {
+	case "header":
+		config.KeySource = RateLimitKeyHeader
+	case "ip_and_header":
+		config.KeySource = RateLimitKeyIPAndHeader
+	default:
+		config.KeySource = RateLimitKeyIP
+	}
+	return config, true, nil
+}
+
+func (b *RedisBackend) MarkDead(host, backendURL string, backendIdx, backendLen int, ttl int) error {
+	conn := b.write.Get()
+	defer conn.Close()
+	expires := time.Now().Add(time.Duration(ttl) * time.Second).Unix()
+	_, err := conn.Do("HSET", frontendDeadKey(host), backendIdx, expires)
+	if err != nil {
+		return fmt.Errorf("error marking %s backend %d dead: %s", host, backendIdx, err)
+	}
+	return nil
+}
+
+// MarkAlive returns backend to rotation immediately, without waiting for
+// its MarkDead entry to expire.
+func (b *RedisBackend) MarkAlive(host, backendURL string, backendIdx, backendLen int) error {
+	conn := b.write.Get()
+	defer conn.Close()
+	_, err := conn.Do("HDEL", frontendDeadKey(host), backendIdx)
+	if err != nil {
+		return fmt.Errorf("error marking %s backend %d alive: %s", host, backendIdx, err)
+	}
+	return nil
+}
+
+// HealthCheckConfig reads the per-frontend active health check policy
+// from the frontend:<host>:healthcheck hash. ok is false when the hash
+// doesn't exist, meaning host has no health check configured.
+func (b *RedisBackend) HealthCheckConfig(host string) (healthcheck.Config, bool, error) {
+	conn := b.read.Get()
+	defer conn.Close()
+	fields, err := redis.StringMap(conn.Do("HGETALL", frontendHealthKey(host)))
+	if err != nil && err != redis.ErrNil {
+		return healthcheck.Config{}, false, fmt.Errorf("error fetching health check config for %s: %s", host, err)
+	}
+	if len(fields) == 0 {
+		return healthcheck.Config{}, false, nil
+	}
+	config := healthcheck.Config{Path: fields["path"]}
+	if secs, err := strconv.Atoi(fields["interval_seconds"]); err == nil {
+		config.Interval = time.Duration(secs) * time.Second
+	}
+	if secs, err := strconv.Atoi(fields["timeout_seconds"]); err == nil {
+		config.Timeout = time.Duration(secs) * time.Second
+	}
+	if ttl, err := strconv.Atoi(fields["dead_ttl"]); err == nil {
+		config.DeadTTL = ttl
+	}
+	if n, err := strconv.Atoi(fields["healthy_threshold"]); err == nil {
+		config.HealthyThreshold = n
+	}
+	if n, err := strconv.Atoi(fields["unhealthy_threshold"]); err == nil {
+		config.UnhealthyThreshold = n
+	}
+	return config, true, nil
+}
+
+// AllFrontends returns every host registered in the frontends set.
+func (b *RedisBackend) AllFrontends() ([]string, error) {
+	conn := b.read.Get()
+	defer conn.Close()
+	hosts, err := redis.Strings(conn.Do("SMEMBERS", frontendsKey))
+	if err != nil && err != redis.ErrNil {
+		return nil, fmt.Errorf("error fetching frontends: %s", err)
+	}
+	return hosts, nil
+}
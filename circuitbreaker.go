@@ -0,0 +1,372 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tsuru/planb/backend"
+)
+
+type breakerState int32
+
+const (
+	breakerStandby breakerState = iota
+	breakerTripped
+	breakerRecovering
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerTripped:
+		return "tripped"
+	case breakerRecovering:
+		return "recovering"
+	default:
+		return "standby"
+	}
+}
+
+// breakerWindow is the size of the rolling window the predicate is
+// evaluated over, sliced into one-second buckets.
+const breakerWindow = 10 * time.Second
+
+type breakerBucket struct {
+	second     int64
+	total      int
+	netErrors  int
+	statusCode [6]int // indexed by statusCode/100; transport errors are counted in netErrors
+}
+
+// breakerMetrics is a rolling window of per-second counters plus a capped
+// sample of recent latencies, used to evaluate the tripping predicate.
+type breakerMetrics struct {
+	mu        sync.Mutex
+	buckets   [int(breakerWindow / time.Second)]breakerBucket
+	latencies []float64
+}
+
+func (m *breakerMetrics) record(d time.Duration, statusCode int, networkErr bool) {
+	now := time.Now().Unix()
+	idx := int(now % int64(len(m.buckets)))
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b := &m.buckets[idx]
+	if b.second != now {
+		*b = breakerBucket{second: now}
+	}
+	b.total++
+	if networkErr {
+		b.netErrors++
+	}
+	if statusCode > 0 {
+		b.statusCode[statusCode/100]++
+	}
+	m.latencies = append(m.latencies, float64(d)/float64(time.Millisecond))
+	if len(m.latencies) > 1000 {
+		m.latencies = m.latencies[len(m.latencies)-1000:]
+	}
+}
+
+func (m *breakerMetrics) window() (total, netErrors int, statusCodes [6]int) {
+	cutoff := time.Now().Add(-breakerWindow).Unix()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, b := range m.buckets {
+		if b.second < cutoff || b.second == 0 {
+			continue
+		}
+		total += b.total
+		netErrors += b.netErrors
+		for i, c := range b.statusCode {
+			statusCodes[i] += c
+		}
+	}
+	return
+}
+
+// NetworkErrorRatio returns the fraction of requests in the window that
+// failed at the transport level (no HTTP response at all).
+func (m *breakerMetrics) NetworkErrorRatio() float64 {
+	total, netErrors, _ := m.window()
+	if total == 0 {
+		return 0
+	}
+	return float64(netErrors) / float64(total)
+}
+
+// ResponseCodeRatio returns the fraction of requests whose status code
+// falls in [from1,to1) divided by the fraction falling in [from2,to2).
+func (m *breakerMetrics) ResponseCodeRatio(from1, to1, from2, to2 int) float64 {
+	_, _, statusCodes := m.window()
+	count := func(from, to int) int {
+		n := 0
+		for code := from; code < to; code += 100 {
+			if code/100 < len(statusCodes) {
+				n += statusCodes[code/100]
+			}
+		}
+		return n
+	}
+	num := count(from1, to1)
+	den := count(from2, to2)
+	if den == 0 {
+		return 0
+	}
+	return float64(num) / float64(den)
+}
+
+// LatencyAtQuantileMS returns an HDR-style approximate latency quantile,
+// in milliseconds, over the last 1000 samples.
+func (m *breakerMetrics) LatencyAtQuantileMS(q float64) float64 {
+	m.mu.Lock()
+	samples := append([]float64(nil), m.latencies...)
+	m.mu.Unlock()
+	if len(samples) == 0 {
+		return 0
+	}
+	sort.Float64s(samples)
+	idx := int(q / 100 * float64(len(samples)))
+	if idx >= len(samples) {
+		idx = len(samples) - 1
+	}
+	return samples[idx]
+}
+
+// breakerPredicate is a compiled tripping expression, e.g.
+// "NetworkErrorRatio() > 0.5 || LatencyAtQuantileMS(50.0) > 500".
+type breakerPredicate func(*breakerMetrics) bool
+
+// parseBreakerPredicate compiles a small boolean expression language so
+// operators can configure tripping conditions in Redis without
+// recompiling planb. It supports `||`, `&&` and calls to the methods of
+// breakerMetrics compared against a float constant, mirroring the feel of
+// oxy's cbreaker predicates.
+func parseBreakerPredicate(expr string) (breakerPredicate, error) {
+	clauses := strings.Split(expr, "||")
+	var orFns []breakerPredicate
+	for _, clause := range clauses {
+		ands := strings.Split(clause, "&&")
+		var andFns []breakerPredicate
+		for _, term := range ands {
+			fn, err := parseBreakerTerm(strings.TrimSpace(term))
+			if err != nil {
+				return nil, err
+			}
+			andFns = append(andFns, fn)
+		}
+		orFns = append(orFns, func(m *breakerMetrics) bool {
+			for _, fn := range andFns {
+				if !fn(m) {
+					return false
+				}
+			}
+			return true
+		})
+	}
+	return func(m *breakerMetrics) bool {
+		for _, fn := range orFns {
+			if fn(m) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+var breakerComparators = []string{">=", "<=", ">", "<", "=="}
+
+func parseBreakerTerm(term string) (breakerPredicate, error) {
+	for _, cmp := range breakerComparators {
+		idx := strings.Index(term, cmp)
+		if idx == -1 {
+			continue
+		}
+		lhs := strings.TrimSpace(term[:idx])
+		rhs := strings.TrimSpace(term[idx+len(cmp):])
+		threshold, err := strconv.ParseFloat(rhs, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid threshold %q in predicate: %s", rhs, err)
+		}
+		fn, err := parseBreakerCall(lhs)
+		if err != nil {
+			return nil, err
+		}
+		switch cmp {
+		case ">=":
+			return func(m *breakerMetrics) bool { return fn(m) >= threshold }, nil
+		case "<=":
+			return func(m *breakerMetrics) bool { return fn(m) <= threshold }, nil
+		case ">":
+			return func(m *breakerMetrics) bool { return fn(m) > threshold }, nil
+		case "<":
+			return func(m *breakerMetrics) bool { return fn(m) < threshold }, nil
+		case "==":
+			return func(m *breakerMetrics) bool { return fn(m) == threshold }, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid predicate term: %q", term)
+}
+
+func parseBreakerCall(call string) (func(*breakerMetrics) float64, error) {
+	open := strings.Index(call, "(")
+	close := strings.LastIndex(call, ")")
+	if open == -1 || close == -1 || close < open {
+		return nil, fmt.Errorf("invalid predicate call: %q", call)
+	}
+	name := strings.TrimSpace(call[:open])
+	args := strings.TrimSpace(call[open+1 : close])
+	var nums []float64
+	if args != "" {
+		for _, a := range strings.Split(args, ",") {
+			n, err := strconv.ParseFloat(strings.TrimSpace(a), 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid argument %q in %q: %s", a, call, err)
+			}
+			nums = append(nums, n)
+		}
+	}
+	switch name {
+	case "NetworkErrorRatio":
+		return func(m *breakerMetrics) float64 { return m.NetworkErrorRatio() }, nil
+	case "LatencyAtQuantileMS":
+		if len(nums) != 1 {
+			return nil, fmt.Errorf("LatencyAtQuantileMS takes one argument")
+		}
+		q := nums[0]
+		return func(m *breakerMetrics) float64 { return m.LatencyAtQuantileMS(q) }, nil
+	case "ResponseCodeRatio":
+		if len(nums) != 4 {
+			return nil, fmt.Errorf("ResponseCodeRatio takes four arguments")
+		}
+		from1, to1, from2, to2 := int(nums[0]), int(nums[1]), int(nums[2]), int(nums[3])
+		return func(m *breakerMetrics) float64 { return m.ResponseCodeRatio(from1, to1, from2, to2) }, nil
+	default:
+		return nil, fmt.Errorf("unknown predicate function %q", name)
+	}
+}
+
+// frontendBreaker is the live circuit breaker for one frontend host.
+type frontendBreaker struct {
+	config    backend.BreakerConfig
+	predicate breakerPredicate
+	metrics   *breakerMetrics
+	state     int32 // breakerState, accessed atomically
+	changedAt int64 // unix nanos, accessed atomically
+}
+
+// defaultRecoverFor is used when an operator leaves RecoverFor unset; admit
+// divides by it while ramping traffic back up during Recovering, so it
+// must never be zero.
+const defaultRecoverFor = 10 * time.Second
+
+func newFrontendBreaker(config backend.BreakerConfig) (*frontendBreaker, error) {
+	predicate, err := parseBreakerPredicate(config.Predicate)
+	if err != nil {
+		return nil, err
+	}
+	if config.RecoverFor <= 0 {
+		config.RecoverFor = defaultRecoverFor
+	}
+	return &frontendBreaker{
+		config:    config,
+		predicate: predicate,
+		metrics:   &breakerMetrics{},
+		changedAt: time.Now().UnixNano(),
+	}, nil
+}
+
+func (b *frontendBreaker) getState() breakerState {
+	return breakerState(atomic.LoadInt32(&b.state))
+}
+
+func (b *frontendBreaker) setState(s breakerState) {
+	atomic.StoreInt32(&b.state, int32(s))
+	atomic.StoreInt64(&b.changedAt, time.Now().UnixNano())
+}
+
+func (b *frontendBreaker) since() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&b.changedAt)))
+}
+
+// admit decides, before dialing the backend, whether this request should
+// go through, be short-circuited to the fallback, or (during Recovering)
+// be ramped in probabilistically.
+func (b *frontendBreaker) admit() bool {
+	switch b.getState() {
+	case breakerTripped:
+		if b.config.TrippedFor > 0 && b.since() >= b.config.TrippedFor {
+			b.setState(breakerRecovering)
+			return b.admit()
+		}
+		return false
+	case breakerRecovering:
+		if b.config.RecoverFor > 0 && b.since() >= b.config.RecoverFor {
+			b.setState(breakerStandby)
+			return true
+		}
+		fraction := float64(b.since()) / float64(b.config.RecoverFor)
+		return rand.Float64() < fraction
+	default:
+		if b.predicate(b.metrics) {
+			b.setState(breakerTripped)
+			return false
+		}
+		return true
+	}
+}
+
+// record feeds a completed request's outcome back into the breaker's
+// rolling window, and re-checks the predicate so a Standby breaker can
+// trip immediately rather than waiting for the next request.
+func (b *frontendBreaker) record(d time.Duration, statusCode int, networkErr bool) {
+	b.metrics.record(d, statusCode, networkErr)
+	if b.getState() == breakerStandby && b.predicate(b.metrics) {
+		b.setState(breakerTripped)
+	}
+}
+
+func (b *frontendBreaker) fallbackResponse(req *http.Request) *http.Response {
+	if b.config.FallbackURL != "" {
+		header := http.Header{"Location": []string{b.config.FallbackURL}}
+		for k, v := range b.config.FallbackHeaders {
+			header.Set(k, v)
+		}
+		return &http.Response{
+			Request:    req,
+			StatusCode: http.StatusFound,
+			ProtoMajor: req.ProtoMajor,
+			ProtoMinor: req.ProtoMinor,
+			Header:     header,
+			Body:       emptyResponseBody,
+		}
+	}
+	statusCode := b.config.FallbackStatusCode
+	if statusCode == 0 {
+		statusCode = http.StatusServiceUnavailable
+	}
+	header := http.Header{}
+	for k, v := range b.config.FallbackHeaders {
+		header.Set(k, v)
+	}
+	body := &FixedReadCloser{value: b.config.FallbackBody}
+	return &http.Response{
+		Request:       req,
+		StatusCode:    statusCode,
+		ProtoMajor:    req.ProtoMajor,
+		ProtoMinor:    req.ProtoMinor,
+		ContentLength: int64(len(b.config.FallbackBody)),
+		Header:        header,
+		Body:          body,
+	}
+}
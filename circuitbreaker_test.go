@@ -0,0 +1,127 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/tsuru/planb/backend"
+)
+
+func TestFrontendBreakerTripsOnBurstOf5xxs(t *testing.T) {
+	b, err := newFrontendBreaker(backend.BreakerConfig{
+		Predicate:  "ResponseCodeRatio(500, 600, 200, 600) > 0.5",
+		TrippedFor: time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !b.admit() {
+		t.Fatalf("expected a fresh breaker in Standby to admit requests")
+	}
+	for i := 0; i < 10; i++ {
+		b.record(time.Millisecond, http.StatusInternalServerError, false)
+	}
+	if b.getState() != breakerTripped {
+		t.Fatalf("expected a burst of 500s to trip the breaker, got state %s", b.getState())
+	}
+	if b.admit() {
+		t.Fatalf("expected a tripped breaker to deny requests")
+	}
+}
+
+func TestFrontendBreakerRampsDuringRecovering(t *testing.T) {
+	b, err := newFrontendBreaker(backend.BreakerConfig{
+		Predicate:  "NetworkErrorRatio() > 0.5",
+		TrippedFor: time.Millisecond,
+		RecoverFor: 100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	b.setState(breakerTripped)
+	time.Sleep(2 * time.Millisecond)
+	// Once TrippedFor has elapsed, admit() transitions Tripped ->
+	// Recovering and starts ramping traffic back in.
+	b.admit()
+	if b.getState() != breakerRecovering {
+		t.Fatalf("expected the breaker to move into Recovering, got %s", b.getState())
+	}
+	time.Sleep(b.config.RecoverFor + 10*time.Millisecond)
+	if !b.admit() {
+		t.Fatalf("expected the breaker to fully recover to Standby once RecoverFor has elapsed")
+	}
+	if b.getState() != breakerStandby {
+		t.Fatalf("expected state to be Standby after recovering, got %s", b.getState())
+	}
+}
+
+func TestNewFrontendBreakerDefaultsRecoverFor(t *testing.T) {
+	b, err := newFrontendBreaker(backend.BreakerConfig{Predicate: "NetworkErrorRatio() > 0.5"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if b.config.RecoverFor <= 0 {
+		t.Fatalf("expected RecoverFor to default to a positive duration, got %s", b.config.RecoverFor)
+	}
+	// Simulates the bug this guards against: dividing by a zero
+	// RecoverFor would make fraction +Inf and admit everything forever.
+	b.setState(breakerRecovering)
+	b.admit()
+	if b.getState() == breakerStandby {
+		t.Fatalf("expected a breaker that just entered Recovering to still be ramping, not fully Standby")
+	}
+}
+
+func TestParseBreakerPredicateAndOr(t *testing.T) {
+	predicate, err := parseBreakerPredicate("NetworkErrorRatio() > 0.9 && LatencyAtQuantileMS(50) > 1000 || ResponseCodeRatio(500, 600, 200, 600) > 0.5")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	m := &breakerMetrics{}
+	for i := 0; i < 4; i++ {
+		m.record(time.Millisecond, http.StatusInternalServerError, false)
+	}
+	m.record(time.Millisecond, http.StatusOK, false)
+	if !predicate(m) {
+		t.Fatalf("expected the ResponseCodeRatio clause alone to satisfy the || predicate")
+	}
+}
+
+func TestParseBreakerPredicateRejectsGarbage(t *testing.T) {
+	if _, err := parseBreakerPredicate("NotAFunction() > 1"); err == nil {
+		t.Fatalf("expected an unknown predicate function to fail to parse")
+	}
+	if _, err := parseBreakerPredicate("NetworkErrorRatio() !! 1"); err == nil {
+		t.Fatalf("expected an invalid comparator to fail to parse")
+	}
+}
+
+func TestFrontendBreakerFallbackResponse(t *testing.T) {
+	b, err := newFrontendBreaker(backend.BreakerConfig{
+		Predicate:          "NetworkErrorRatio() > 0.5",
+		FallbackStatusCode: http.StatusTeapot,
+		FallbackBody:       []byte("no backends for you"),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	rsp := b.fallbackResponse(req)
+	if rsp.StatusCode != http.StatusTeapot {
+		t.Fatalf("expected the configured fallback status code, got %d", rsp.StatusCode)
+	}
+	body, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		t.Fatalf("unexpected error reading fallback body: %s", err)
+	}
+	if string(body) != "no backends for you" {
+		t.Fatalf("unexpected fallback body: %q", body)
+	}
+}
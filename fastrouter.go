@@ -0,0 +1,329 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/golang-lru"
+	"github.com/nu7hatch/gouuid"
+	"github.com/tsuru/planb/backend"
+	"github.com/valyala/fasthttp"
+)
+
+// FastRouter is a `valyala/fasthttp`-based alternative to Router for
+// high-QPS deployments, selected via a CLI flag. It mirrors Router's
+// selection, mark-dead and websocket-hijack behavior and reuses the same
+// backend.RoutesBackend, LRU cache and Logger, but skips net/http's
+// allocations on the hot path.
+type FastRouter struct {
+	ReadRedisHost   string
+	ReadRedisPort   int
+	WriteRedisHost  string
+	WriteRedisPort  int
+	LogPath         string
+	DialTimeout     time.Duration
+	RequestTimeout  time.Duration
+	DeadBackendTTL  int
+	RequestIDHeader string
+	dialer          *net.Dialer
+	client          *fasthttp.Client
+	backend         backend.RoutesBackend
+	logger          *Logger
+	rrMutex         sync.RWMutex
+	roundRobin      map[string]*int32
+	cache           *lru.Cache
+	markingDisabled bool
+}
+
+func (router *FastRouter) Init() error {
+	var err error
+	if router.backend == nil {
+		be, err := backend.NewRedisBackend(backend.RedisOptions{}, backend.RedisOptions{})
+		if err != nil {
+			return err
+		}
+		router.backend = be
+	}
+	if router.LogPath == "" {
+		router.LogPath = "./access.log"
+	}
+	if router.logger == nil && router.LogPath != "none" {
+		router.logger, err = NewFileLogger(router.LogPath)
+		if err != nil {
+			return err
+		}
+	}
+	if router.DeadBackendTTL == 0 {
+		router.DeadBackendTTL = 30
+	}
+	if router.cache == nil {
+		router.cache, err = lru.New(100)
+		if err != nil {
+			return err
+		}
+	}
+	router.dialer = &net.Dialer{
+		Timeout:   router.DialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	router.client = &fasthttp.Client{
+		Dial:                router.dialer.Dial,
+		MaxConnsPerHost:     200,
+		MaxIdleConnDuration: 90 * time.Second,
+	}
+	router.roundRobin = make(map[string]*int32)
+	return nil
+}
+
+func (router *FastRouter) Stop() {
+	if router.logger != nil {
+		router.logger.Stop()
+	}
+}
+
+func (router *FastRouter) getBackends(host string) (*backendSet, error) {
+	if data, ok := router.cache.Get(host); ok {
+		set := data.(backendSet)
+		if !set.Expired() {
+			return &set, nil
+		}
+	}
+	var set backendSet
+	var err error
+	set.id, set.backends, set.dead, set.sticky, err = router.backend.Backends(host)
+	if err != nil {
+		return nil, fmt.Errorf("error running routes backend commands: %s", err)
+	}
+	set.expires = time.Now().Add(2 * time.Second)
+	router.cache.Add(host, set)
+	return &set, nil
+}
+
+func (router *FastRouter) chooseBackend(host string) (*requestData, error) {
+	reqData := &requestData{host: host, startTime: time.Now()}
+	set, err := router.getBackends(host)
+	if err != nil {
+		return reqData, err
+	}
+	reqData.backendKey = set.id
+	reqData.backendLen = len(set.backends)
+	router.rrMutex.RLock()
+	roundRobin := router.roundRobin[host]
+	if roundRobin == nil {
+		router.rrMutex.RUnlock()
+		router.rrMutex.Lock()
+		roundRobin = router.roundRobin[host]
+		if roundRobin == nil {
+			roundRobin = new(int32)
+			router.roundRobin[host] = roundRobin
+		}
+		router.rrMutex.Unlock()
+	} else {
+		router.rrMutex.RUnlock()
+	}
+	initialNumber := atomic.AddInt32(roundRobin, 1)
+	initialNumber = (initialNumber - 1) % int32(reqData.backendLen)
+	toUseNumber := -1
+	for chosenNumber := initialNumber; ; {
+		_, isDead := set.dead[int(chosenNumber)]
+		if !isDead {
+			toUseNumber = int(chosenNumber)
+			break
+		}
+		chosenNumber = (chosenNumber + 1) % int32(reqData.backendLen)
+		if chosenNumber == initialNumber {
+			break
+		}
+	}
+	if toUseNumber == -1 {
+		return reqData, errors.New("all backends are dead")
+	}
+	reqData.backendIdx = toUseNumber
+	reqData.backend = set.backends[toUseNumber]
+	return reqData, nil
+}
+
+// RequestHandler is a fasthttp.RequestHandler that selects a backend,
+// proxies the request and marks dead backends exactly like Router does.
+func (router *FastRouter) RequestHandler(ctx *fasthttp.RequestCtx) {
+	host := string(ctx.Host())
+	if host == "__ping__" && string(ctx.Path()) == "/" {
+		ctx.SetStatusCode(fasthttp.StatusOK)
+		ctx.SetBodyString("OK")
+		return
+	}
+	if strings.EqualFold(string(ctx.Request.Header.Peek("Upgrade")), "websocket") {
+		router.serveWebsocket(ctx, host)
+		return
+	}
+	debug := len(ctx.Request.Header.Peek("X-Debug-Router")) > 0
+	ctx.Request.Header.Del("X-Debug-Router")
+	reqData, err := router.chooseBackend(host)
+	if err != nil {
+		logError(reqData.String(), string(ctx.Path()), err)
+		ctx.SetStatusCode(fasthttp.StatusServiceUnavailable)
+		return
+	}
+	req := fasthttp.AcquireRequest()
+	rsp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(rsp)
+	ctx.Request.Header.CopyTo(&req.Header)
+	req.SetBody(ctx.Request.Body())
+	req.SetRequestURI(reqData.backend + string(ctx.RequestURI()))
+	req.Header.Set("X-Host", host)
+	if router.RequestIDHeader != "" && len(req.Header.Peek(router.RequestIDHeader)) == 0 {
+		unparsedID, err := uuid.NewV4()
+		if err == nil {
+			req.Header.Set(router.RequestIDHeader, unparsedID.String())
+		}
+	}
+	t0 := time.Now().UTC()
+	timeout := router.RequestTimeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	err = router.client.DoTimeout(req, rsp, timeout)
+	backendDuration := time.Since(t0)
+	if err != nil {
+		markAsDead := false
+		if netErr, ok := err.(net.Error); ok {
+			markAsDead = !netErr.Temporary()
+		}
+		if err == fasthttp.ErrTimeout {
+			markAsDead = false
+		}
+		logErr := fmt.Errorf("error in backend request: %s", err)
+		if markAsDead {
+			logErr = fmt.Errorf("%s *DEAD*", logErr)
+		}
+		logError(reqData.String(), string(ctx.Path()), logErr)
+		if markAsDead && !router.markingDisabled {
+			markErr := router.backend.MarkDead(reqData.host, reqData.backend, reqData.backendIdx, reqData.backendLen, router.DeadBackendTTL)
+			if markErr != nil {
+				logError(reqData.String(), string(ctx.Path()), fmt.Errorf("error markind dead backend in routes backend: %s", markErr))
+			}
+		}
+		ctx.SetStatusCode(fasthttp.StatusServiceUnavailable)
+		return
+	}
+	rsp.Header.CopyTo(&ctx.Response.Header)
+	ctx.SetStatusCode(rsp.StatusCode())
+	ctx.SetBody(rsp.Body())
+	if debug {
+		ctx.Response.Header.Set("X-Debug-Backend-Url", reqData.backend)
+		ctx.Response.Header.Set("X-Debug-Backend-Id", strconv.Itoa(reqData.backendIdx))
+		ctx.Response.Header.Set("X-Debug-Frontend-Key", reqData.host)
+	}
+	if router.logger != nil {
+		router.logger.MessageRaw(&logEntry{
+			now:             time.Now(),
+			req:             fastRequestToStd(&ctx.Request, host),
+			rsp:             fastResponseToStd(rsp),
+			backendDuration: backendDuration,
+			totalDuration:   time.Since(reqData.startTime),
+			backendKey:      reqData.backendKey,
+		})
+	}
+}
+
+// fastRequestToStd adapts the parts of a fasthttp.Request the shared
+// Logger cares about (method, path, headers) into a *http.Request, since
+// logEntry is shared with the net/http-based Router.
+func fastRequestToStd(req *fasthttp.Request, host string) *http.Request {
+	header := http.Header{}
+	req.Header.VisitAll(func(k, v []byte) {
+		header.Add(string(k), string(v))
+	})
+	return &http.Request{
+		Method: string(req.Header.Method()),
+		Host:   host,
+		URL:    &url.URL{Path: string(req.URI().Path()), RawQuery: string(req.URI().QueryString())},
+		Header: header,
+		Proto:  "HTTP/1.1",
+	}
+}
+
+// fastResponseToStd adapts a fasthttp.Response into a *http.Response for
+// the same reason as fastRequestToStd.
+func fastResponseToStd(rsp *fasthttp.Response) *http.Response {
+	header := http.Header{}
+	rsp.Header.VisitAll(func(k, v []byte) {
+		header.Add(string(k), string(v))
+	})
+	return &http.Response{
+		StatusCode:    rsp.StatusCode(),
+		ContentLength: int64(len(rsp.Body())),
+		Header:        header,
+	}
+}
+
+// serveWebsocket upgrades ctx via Hijack and pipes bytes directly to/from
+// the chosen backend, matching Router.serveWebsocket's behavior.
+func (router *FastRouter) serveWebsocket(ctx *fasthttp.RequestCtx, host string) {
+	reqData, err := router.chooseBackend(host)
+	if err != nil {
+		logError(reqData.String(), string(ctx.Path()), err)
+		ctx.SetStatusCode(fasthttp.StatusBadGateway)
+		return
+	}
+	backendURL, err := url.Parse(reqData.backend)
+	if err != nil {
+		logError(reqData.String(), string(ctx.Path()), err)
+		ctx.SetStatusCode(fasthttp.StatusBadGateway)
+		return
+	}
+	dstConn, err := router.dialer.Dial("tcp", backendURL.Host)
+	if err != nil {
+		logError(reqData.String(), string(ctx.Path()), err)
+		ctx.SetStatusCode(fasthttp.StatusBadGateway)
+		return
+	}
+	bw := bufio.NewWriter(dstConn)
+	if err = ctx.Request.Write(bw); err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		dstConn.Close()
+		logError(reqData.String(), string(ctx.Path()), err)
+		ctx.SetStatusCode(fasthttp.StatusBadGateway)
+		return
+	}
+	ctx.Hijack(func(conn net.Conn) {
+		defer dstConn.Close()
+		errc := make(chan error, 2)
+		cp := func(dst *bufio.Writer, src net.Conn) {
+			buf := make([]byte, 32*1024)
+			for {
+				n, err := src.Read(buf)
+				if n > 0 {
+					if _, werr := dst.Write(buf[:n]); werr != nil {
+						errc <- werr
+						return
+					}
+					dst.Flush()
+				}
+				if err != nil {
+					errc <- err
+					return
+				}
+			}
+		}
+		go cp(bufio.NewWriter(dstConn), conn)
+		go cp(bufio.NewWriter(conn), dstConn)
+		<-errc
+	})
+}
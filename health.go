@@ -0,0 +1,94 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/tsuru/planb/healthcheck"
+)
+
+const healthCheckTick = time.Second
+
+// healthCheckTargets enumerates every known (host, backend) pair across
+// all frontends, for the active health checker to probe. It bypasses the
+// short-lived request cache and asks the routes backend directly so
+// backends with no recent traffic still get probed.
+func (router *Router) healthCheckTargets() []healthcheck.Target {
+	hosts, err := router.backend.AllFrontends()
+	if err != nil {
+		logError("healthcheck", "", err)
+		return nil
+	}
+	var targets []healthcheck.Target
+	for _, host := range hosts {
+		_, backends, _, _, err := router.backend.Backends(host)
+		if err != nil {
+			logError("healthcheck", host, err)
+			continue
+		}
+		for idx, backendURL := range backends {
+			targets = append(targets, healthcheck.Target{
+				Host:       host,
+				Backend:    backendURL,
+				BackendIdx: idx,
+				BackendLen: len(backends),
+			})
+		}
+	}
+	return targets
+}
+
+// healthCheckConfigFor adapts the per-frontend config stored in the routes
+// backend to a healthcheck.Config. A host with no health check
+// configuration gets a zero-value Config, which healthcheck.Checker skips.
+func (router *Router) healthCheckConfigFor(host string) healthcheck.Config {
+	config, ok, err := router.backend.HealthCheckConfig(host)
+	if err != nil {
+		logError("healthcheck", host, err)
+		return healthcheck.Config{}
+	}
+	if !ok {
+		return healthcheck.Config{}
+	}
+	if config.DeadTTL == 0 {
+		config.DeadTTL = router.DeadBackendTTL
+	}
+	// An operator who doesn't set a threshold almost certainly wants
+	// "a couple of bad probes", not "trip dead/alive on the very next
+	// probe" - healthcheck.Checker only guarantees a minimum of 1.
+	if config.HealthyThreshold == 0 {
+		config.HealthyThreshold = 2
+	}
+	if config.UnhealthyThreshold == 0 {
+		config.UnhealthyThreshold = 2
+	}
+	return config
+}
+
+func (router *Router) startHealthChecker() {
+	if !router.HealthCheckEnabled {
+		return
+	}
+	concurrency := router.HealthCheckConcurrency
+	if concurrency == 0 {
+		concurrency = 10
+	}
+	router.healthChecker = healthcheck.NewChecker(router.backend, concurrency)
+	go router.healthChecker.Run(router.healthCheckTargets, router.healthCheckConfigFor, healthCheckTick)
+}
+
+// serveHealthCheckStatus answers the __healthcheck__ debug host with the
+// current health of every actively-probed backend, as JSON.
+func (router *Router) serveHealthCheckStatus(rw http.ResponseWriter) {
+	if router.healthChecker == nil {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(router.healthChecker.Status())
+}
@@ -0,0 +1,255 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package healthcheck implements active, background probing of backends so
+// a dead backend can be marked before it ever receives real traffic, and a
+// recovered one can be brought back without waiting for its dead TTL to
+// expire.
+package healthcheck
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Backend is the subset of backend.RoutesBackend the checker needs to mark
+// backends dead or alive as probes succeed or fail.
+type Backend interface {
+	MarkDead(host, backend string, backendIdx, backendLen int, ttl int) error
+	MarkAlive(host, backend string, backendIdx, backendLen int) error
+}
+
+// Target identifies a single backend to probe.
+type Target struct {
+	Host       string
+	Backend    string
+	BackendIdx int
+	BackendLen int
+}
+
+func (t Target) key() string {
+	return t.Host + "|" + t.Backend
+}
+
+// Config is the per-frontend probing policy.
+type Config struct {
+	Interval           time.Duration
+	Path               string
+	Timeout            time.Duration
+	ExpectedCodes      map[int]bool
+	HealthyThreshold   int
+	UnhealthyThreshold int
+	DeadTTL            int
+}
+
+// Status is the point-in-time health of one backend, returned by the
+// debug endpoint.
+type Status struct {
+	Host          string    `json:"host"`
+	Backend       string    `json:"backend"`
+	Dead          bool      `json:"dead"`
+	LastCheck     time.Time `json:"last_check"`
+	LatencyMS     float64   `json:"latency_ms"`
+	ConsecutiveOK int       `json:"consecutive_ok"`
+	ConsecutiveKO int       `json:"consecutive_ko"`
+}
+
+type probeState struct {
+	mu            sync.Mutex
+	dead          bool
+	consecutiveOK int
+	consecutiveKO int
+	lastCheck     time.Time
+	lastAttempt   time.Time
+	latencyEWMA   float64
+}
+
+// Checker periodically probes every known backend and reports consecutive
+// successes/failures against each frontend's thresholds. Probes are keyed
+// by (frontend host, backend URL): a target listed twice for the same host
+// is probed once per tick, but a backend URL shared by several frontends
+// is probed separately for each of them.
+type Checker struct {
+	backend     Backend
+	client      *http.Client
+	concurrency chan struct{}
+	stop        chan struct{}
+
+	mu     sync.Mutex
+	states map[string]*probeState
+}
+
+// NewChecker creates a Checker that runs at most concurrency probes at
+// once.
+func NewChecker(backend Backend, concurrency int) *Checker {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &Checker{
+		backend:     backend,
+		client:      &http.Client{},
+		concurrency: make(chan struct{}, concurrency),
+		stop:        make(chan struct{}),
+		states:      make(map[string]*probeState),
+	}
+}
+
+// Run wakes up every tick and probes each target returned by targets whose
+// host's Config (as returned by configFor) has an Interval that has
+// elapsed since that target's last attempt. It blocks until Stop is
+// called.
+func (c *Checker) Run(targets func() []Target, configFor func(host string) Config, tick time.Duration) {
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			c.probeAll(targets(), configFor)
+		}
+	}
+}
+
+// Stop terminates the background probing loop started by Run.
+func (c *Checker) Stop() {
+	close(c.stop)
+}
+
+func (c *Checker) probeAll(targetList []Target, configFor func(host string) Config) {
+	seen := make(map[string]bool, len(targetList))
+	var wg sync.WaitGroup
+	for _, target := range targetList {
+		if seen[target.key()] {
+			continue
+		}
+		seen[target.key()] = true
+		config := configFor(target.Host)
+		if config.Interval <= 0 || !c.due(target, config.Interval) {
+			continue
+		}
+		wg.Add(1)
+		go func(target Target, config Config) {
+			defer wg.Done()
+			c.concurrency <- struct{}{}
+			defer func() { <-c.concurrency }()
+			c.probeOne(target, config)
+		}(target, config)
+	}
+	wg.Wait()
+}
+
+// due reports whether target hasn't been probed (or attempted) within
+// interval, and if so immediately marks it attempted so two overlapping
+// ticks can't both launch a probe for a slow backend.
+func (c *Checker) due(target Target, interval time.Duration) bool {
+	state := c.stateFor(target)
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if time.Since(state.lastAttempt) < interval {
+		return false
+	}
+	state.lastAttempt = time.Now()
+	return true
+}
+
+func (c *Checker) stateFor(target Target) *probeState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.states[target.key()]
+	if s == nil {
+		s = &probeState{}
+		c.states[target.key()] = s
+	}
+	return s
+}
+
+func (c *Checker) probeOne(target Target, config Config) {
+	state := c.stateFor(target)
+	client := c.client
+	if config.Timeout > 0 {
+		clientCopy := *c.client
+		clientCopy.Timeout = config.Timeout
+		client = &clientCopy
+	}
+	t0 := time.Now()
+	rsp, err := client.Get(target.Backend + config.Path)
+	latency := time.Since(t0)
+	ok := err == nil
+	if ok {
+		defer rsp.Body.Close()
+		if len(config.ExpectedCodes) > 0 && !config.ExpectedCodes[rsp.StatusCode] {
+			ok = false
+		}
+	}
+	state.mu.Lock()
+	state.lastCheck = t0
+	state.latencyEWMA = 0.1*float64(latency/time.Millisecond) + 0.9*state.latencyEWMA
+	if ok {
+		state.consecutiveOK++
+		state.consecutiveKO = 0
+	} else {
+		state.consecutiveKO++
+		state.consecutiveOK = 0
+	}
+	healthyThreshold := config.HealthyThreshold
+	if healthyThreshold < 1 {
+		healthyThreshold = 1
+	}
+	unhealthyThreshold := config.UnhealthyThreshold
+	if unhealthyThreshold < 1 {
+		unhealthyThreshold = 1
+	}
+	becameAlive := ok && state.dead && state.consecutiveOK >= healthyThreshold
+	becameDead := !ok && !state.dead && state.consecutiveKO >= unhealthyThreshold
+	if becameAlive {
+		state.dead = false
+	}
+	if becameDead {
+		state.dead = true
+	}
+	state.mu.Unlock()
+	if becameDead {
+		c.backend.MarkDead(target.Host, target.Backend, target.BackendIdx, target.BackendLen, config.DeadTTL)
+	}
+	if becameAlive {
+		c.backend.MarkAlive(target.Host, target.Backend, target.BackendIdx, target.BackendLen)
+	}
+}
+
+// Status returns a snapshot of every probed backend's current health, for
+// a debug endpoint.
+func (c *Checker) Status() []Status {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make([]Status, 0, len(c.states))
+	for key, s := range c.states {
+		s.mu.Lock()
+		var host, backend string
+		if idx := indexOfByte(key, '|'); idx != -1 {
+			host, backend = key[:idx], key[idx+1:]
+		}
+		out = append(out, Status{
+			Host:          host,
+			Backend:       backend,
+			Dead:          s.dead,
+			LastCheck:     s.lastCheck,
+			LatencyMS:     s.latencyEWMA,
+			ConsecutiveOK: s.consecutiveOK,
+			ConsecutiveKO: s.consecutiveKO,
+		})
+		s.mu.Unlock()
+	}
+	return out
+}
+
+func indexOfByte(s string, b byte) int {
+	for i := 0; i < len(s); i++ {
+		if s[i] == b {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,197 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package healthcheck
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeMarker struct {
+	mu    sync.Mutex
+	dead  []string
+	alive []string
+}
+
+func (f *fakeMarker) MarkDead(host, backend string, backendIdx, backendLen int, ttl int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.dead = append(f.dead, backend)
+	return nil
+}
+
+func (f *fakeMarker) MarkAlive(host, backend string, backendIdx, backendLen int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.alive = append(f.alive, backend)
+	return nil
+}
+
+func (f *fakeMarker) deadCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.dead)
+}
+
+func (f *fakeMarker) aliveCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.alive)
+}
+
+func TestProbeOneMarksDeadAfterUnhealthyThreshold(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	marker := &fakeMarker{}
+	c := NewChecker(marker, 1)
+	target := Target{Host: "example.com", Backend: srv.URL, BackendIdx: 0, BackendLen: 1}
+	config := Config{
+		Path:               "/",
+		ExpectedCodes:      map[int]bool{http.StatusOK: true},
+		UnhealthyThreshold: 3,
+	}
+
+	c.probeOne(target, config)
+	c.probeOne(target, config)
+	if marker.deadCount() != 0 {
+		t.Fatalf("expected no MarkDead call before reaching the threshold, got %d", marker.deadCount())
+	}
+	c.probeOne(target, config)
+	if marker.deadCount() != 1 {
+		t.Fatalf("expected exactly one MarkDead call once the threshold is reached, got %d", marker.deadCount())
+	}
+	// Further failing probes must not call MarkDead again: it's already dead.
+	c.probeOne(target, config)
+	if marker.deadCount() != 1 {
+		t.Fatalf("expected MarkDead not to be called again while already dead, got %d", marker.deadCount())
+	}
+}
+
+func TestProbeOneMarksAliveAfterHealthyThreshold(t *testing.T) {
+	healthy := true
+	var mu sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if healthy {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	marker := &fakeMarker{}
+	c := NewChecker(marker, 1)
+	target := Target{Host: "example.com", Backend: srv.URL, BackendIdx: 0, BackendLen: 1}
+	config := Config{
+		Path:               "/",
+		ExpectedCodes:      map[int]bool{http.StatusOK: true},
+		UnhealthyThreshold: 1,
+		HealthyThreshold:   2,
+	}
+
+	mu.Lock()
+	healthy = false
+	mu.Unlock()
+	c.probeOne(target, config)
+	if marker.deadCount() != 1 {
+		t.Fatalf("expected the backend to be marked dead first")
+	}
+
+	mu.Lock()
+	healthy = true
+	mu.Unlock()
+	c.probeOne(target, config)
+	if marker.aliveCount() != 0 {
+		t.Fatalf("expected no MarkAlive call before reaching the healthy threshold")
+	}
+	c.probeOne(target, config)
+	if marker.aliveCount() != 1 {
+		t.Fatalf("expected exactly one MarkAlive call once the healthy threshold is reached, got %d", marker.aliveCount())
+	}
+}
+
+func TestProbeOneDefaultsThresholdsToOne(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	marker := &fakeMarker{}
+	c := NewChecker(marker, 1)
+	target := Target{Host: "example.com", Backend: srv.URL}
+	// A zero-value Config (the zero thresholds an operator gets if they
+	// never set one) is treated as a threshold of 1: a single failing
+	// probe marks the backend dead.
+	config := Config{Path: "/", ExpectedCodes: map[int]bool{http.StatusOK: true}}
+
+	c.probeOne(target, config)
+	if marker.deadCount() != 1 {
+		t.Fatalf("expected the default threshold of 1 to still trip dead on a single failing probe, got %d", marker.deadCount())
+	}
+}
+
+func TestDueHonorsConfiguredInterval(t *testing.T) {
+	c := NewChecker(&fakeMarker{}, 1)
+	target := Target{Host: "example.com", Backend: "http://127.0.0.1:1"}
+
+	if !c.due(target, time.Hour) {
+		t.Fatalf("expected the first check for a target to always be due")
+	}
+	if c.due(target, time.Hour) {
+		t.Fatalf("expected a target probed moments ago with a 1h interval to not be due yet")
+	}
+	if !c.due(target, time.Nanosecond) {
+		t.Fatalf("expected a target to be due again once its interval has elapsed")
+	}
+}
+
+func TestProbeAllSkipsTargetsWithNoInterval(t *testing.T) {
+	marker := &fakeMarker{}
+	c := NewChecker(marker, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	targets := []Target{{Host: "example.com", Backend: srv.URL}}
+	configFor := func(host string) Config {
+		return Config{Path: "/", ExpectedCodes: map[int]bool{http.StatusOK: true}}
+	}
+	c.probeAll(targets, configFor)
+	if marker.deadCount() != 0 {
+		t.Fatalf("expected a target with Interval <= 0 (health checks disabled) to never be probed")
+	}
+}
+
+func TestStatusReportsProbedTarget(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	marker := &fakeMarker{}
+	c := NewChecker(marker, 1)
+	target := Target{Host: "a.example.com", Backend: srv.URL, BackendIdx: 0, BackendLen: 1}
+	c.probeOne(target, Config{Path: "/", ExpectedCodes: map[int]bool{http.StatusOK: true}})
+
+	statuses := c.Status()
+	if len(statuses) != 1 {
+		t.Fatalf("expected exactly one status entry, got %d", len(statuses))
+	}
+	if statuses[0].Host != "a.example.com" || statuses[0].Backend != srv.URL {
+		t.Fatalf("unexpected status entry: %+v", statuses[0])
+	}
+	if statuses[0].Dead {
+		t.Fatalf("expected a successful probe to report the backend as alive")
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package ratelimit implements an in-memory, sharded token-bucket rate
+// limiter keyed by an arbitrary string (client IP, header value, or a
+// tuple of both).
+package ratelimit
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/golang-lru"
+)
+
+// shardCount controls contention under high QPS: each shard owns its own
+// lock and its own bounded LRU of buckets.
+const shardCount = 32
+
+type bucket struct {
+	tokens     float64
+	lastRefill time.Time
+}
+
+type shard struct {
+	mu    sync.Mutex
+	cache *lru.Cache
+}
+
+// Limiter is a token-bucket rate limiter. Each distinct key gets its own
+// bucket; the total number of tracked keys is bounded by size (but never
+// fewer than one key per shard), each shard evicting its least recently
+// used key once full.
+type Limiter struct {
+	shards [shardCount]*shard
+}
+
+// NewLimiter creates a Limiter whose per-shard LRU holds up to
+// size/shardCount keys (minimum 1).
+func NewLimiter(size int) (*Limiter, error) {
+	perShard := size / shardCount
+	if perShard < 1 {
+		perShard = 1
+	}
+	l := &Limiter{}
+	for i := range l.shards {
+		cache, err := lru.New(perShard)
+		if err != nil {
+			return nil, err
+		}
+		l.shards[i] = &shard{cache: cache}
+	}
+	return l, nil
+}
+
+func (l *Limiter) shardFor(key string) *shard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return l.shards[h.Sum32()%shardCount]
+}
+
+// Result describes the outcome of an Allow call, enough to populate
+// Retry-After and X-RateLimit-* response headers.
+type Result struct {
+	Allowed    bool
+	Limit      float64
+	Remaining  float64
+	RetryAfter time.Duration
+}
+
+// Allow consumes one token from key's bucket, refilling it at rate
+// tokens/second up to a maximum of burst tokens. A key seen for the first
+// time starts with a full bucket.
+func (l *Limiter) Allow(key string, rate, burst float64) Result {
+	s := l.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	var b *bucket
+	if cached, ok := s.cache.Get(key); ok {
+		b = cached.(*bucket)
+	} else {
+		b = &bucket{tokens: burst, lastRefill: now}
+		s.cache.Add(key, b)
+	}
+	elapsed := now.Sub(b.lastRefill).Seconds()
+	b.tokens += elapsed * rate
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.lastRefill = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return Result{Allowed: true, Limit: burst, Remaining: b.tokens}
+	}
+	var retryAfter time.Duration
+	if rate > 0 {
+		retryAfter = time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+	return Result{Allowed: false, Limit: burst, Remaining: b.tokens, RetryAfter: retryAfter}
+}
@@ -0,0 +1,151 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// these tune the EWMA smoothing and effective-weight recompute cadence; they
+// are constants rather than Router fields because operators have no sane
+// reason to vary them per deployment.
+const (
+	latencyEWMAAlpha    = 0.1
+	rebalanceEvery      = 256
+	rebalanceMinRatio   = 0.1
+	rebalanceMaxRatio   = 10.0
+	rebalanceMaxWeight  = 100
+	rebalanceBaseWeight = 10
+)
+
+// backendWeight holds the smooth weighted round-robin state for a single
+// backend, plus the EWMA signals used to recompute its effective weight.
+type backendWeight struct {
+	currentWeight   int
+	effectiveWeight int
+	latencyEWMA     float64
+	errorEWMA       float64
+}
+
+// swrrState is the Nginx-style smooth weighted round-robin state for every
+// backend of a single frontend host.
+type swrrState struct {
+	mu       sync.Mutex
+	weights  []*backendWeight
+	requests int
+}
+
+func newSWRRState(n int) *swrrState {
+	weights := make([]*backendWeight, n)
+	for i := range weights {
+		weights[i] = &backendWeight{effectiveWeight: rebalanceBaseWeight}
+	}
+	return &swrrState{weights: weights}
+}
+
+// pick returns the index of the chosen backend, skipping any index present
+// in dead, using Nginx's smooth weighted round-robin algorithm.
+func (s *swrrState) pick(dead map[int]struct{}) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	total := 0
+	best := -1
+	for i, w := range s.weights {
+		if _, isDead := dead[i]; isDead {
+			continue
+		}
+		w.currentWeight += w.effectiveWeight
+		total += w.effectiveWeight
+		if best == -1 || w.currentWeight > s.weights[best].currentWeight {
+			best = i
+		}
+	}
+	if best == -1 {
+		return -1
+	}
+	s.weights[best].currentWeight -= total
+	return best
+}
+
+// effectiveWeightOf safely reads idx's current effective weight, for the
+// debug headers - effectiveWeight is otherwise only touched under s.mu by
+// pick/update/recompute.
+func (s *swrrState) effectiveWeightOf(idx int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.weights[idx].effectiveWeight
+}
+
+// update feeds the outcome of one request into the backend's EWMAs and,
+// every rebalanceEvery requests, recomputes every effective weight.
+func (s *swrrState) update(idx int, duration time.Duration, failed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if idx < 0 || idx >= len(s.weights) {
+		return
+	}
+	w := s.weights[idx]
+	latencyMS := float64(duration) / float64(time.Millisecond)
+	errSample := 0.0
+	if failed {
+		errSample = 1.0
+	}
+	if w.latencyEWMA == 0 {
+		w.latencyEWMA = latencyMS
+	} else {
+		w.latencyEWMA = latencyEWMAAlpha*latencyMS + (1-latencyEWMAAlpha)*w.latencyEWMA
+	}
+	w.errorEWMA = latencyEWMAAlpha*errSample + (1-latencyEWMAAlpha)*w.errorEWMA
+	s.requests++
+	if s.requests >= rebalanceEvery {
+		s.requests = 0
+		s.recompute()
+	}
+}
+
+func (s *swrrState) recompute() {
+	median := s.medianLatency()
+	for _, w := range s.weights {
+		ratio := 1.0
+		if w.latencyEWMA > 0 && median > 0 {
+			ratio = median / w.latencyEWMA
+		}
+		if ratio < rebalanceMinRatio {
+			ratio = rebalanceMinRatio
+		} else if ratio > rebalanceMaxRatio {
+			ratio = rebalanceMaxRatio
+		}
+		effective := int(rebalanceBaseWeight * ratio * (1 - w.errorEWMA))
+		if effective < 1 {
+			effective = 1
+		} else if effective > rebalanceMaxWeight {
+			effective = rebalanceMaxWeight
+		}
+		w.effectiveWeight = effective
+	}
+}
+
+func (s *swrrState) medianLatency() float64 {
+	latencies := make([]float64, 0, len(s.weights))
+	for _, w := range s.weights {
+		if w.latencyEWMA > 0 {
+			latencies = append(latencies, w.latencyEWMA)
+		}
+	}
+	if len(latencies) == 0 {
+		return 0
+	}
+	// Selection is infrequent (every rebalanceEvery requests) and n is the
+	// backend count, so an O(n^2) sort here is not worth a dependency.
+	for i := range latencies {
+		for j := i + 1; j < len(latencies); j++ {
+			if latencies[j] < latencies[i] {
+				latencies[i], latencies[j] = latencies[j], latencies[i]
+			}
+		}
+	}
+	return latencies[len(latencies)/2]
+}
@@ -0,0 +1,77 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSWRRPickDistributesByEffectiveWeight(t *testing.T) {
+	s := newSWRRState(2)
+	s.weights[0].effectiveWeight = 3
+	s.weights[1].effectiveWeight = 1
+	counts := make(map[int]int)
+	for i := 0; i < 8; i++ {
+		counts[s.pick(nil)]++
+	}
+	if counts[0] != 6 || counts[1] != 2 {
+		t.Fatalf("expected a 3:1 weight ratio to yield a 6:2 pick ratio over 8 picks, got %v", counts)
+	}
+}
+
+func TestSWRRPickSkipsDeadBackends(t *testing.T) {
+	s := newSWRRState(3)
+	dead := map[int]struct{}{0: {}, 1: {}}
+	for i := 0; i < 5; i++ {
+		if idx := s.pick(dead); idx != 2 {
+			t.Fatalf("expected only the live backend (index 2) to ever be picked, got %d", idx)
+		}
+	}
+}
+
+func TestSWRRPickReturnsMinusOneWhenAllDead(t *testing.T) {
+	s := newSWRRState(2)
+	dead := map[int]struct{}{0: {}, 1: {}}
+	if idx := s.pick(dead); idx != -1 {
+		t.Fatalf("expected -1 when every backend is dead, got %d", idx)
+	}
+}
+
+func TestSWRRUpdateRecomputesWeightsTowardFasterBackend(t *testing.T) {
+	s := newSWRRState(2)
+	for i := 0; i < rebalanceEvery; i++ {
+		s.update(0, 10*time.Millisecond, false)
+		s.update(1, 200*time.Millisecond, false)
+	}
+	fast := s.effectiveWeightOf(0)
+	slow := s.effectiveWeightOf(1)
+	if fast <= slow {
+		t.Fatalf("expected the consistently faster backend to end up with a higher effective weight, fast=%d slow=%d", fast, slow)
+	}
+}
+
+func TestSWRRUpdatePenalizesErrors(t *testing.T) {
+	s := newSWRRState(2)
+	for i := 0; i < rebalanceEvery; i++ {
+		s.update(0, 10*time.Millisecond, false)
+		s.update(1, 10*time.Millisecond, true)
+	}
+	healthy := s.effectiveWeightOf(0)
+	failing := s.effectiveWeightOf(1)
+	if healthy <= failing {
+		t.Fatalf("expected the consistently failing backend to end up with a lower effective weight, healthy=%d failing=%d", healthy, failing)
+	}
+}
+
+func TestSWRREffectiveWeightNeverDropsBelowOne(t *testing.T) {
+	s := newSWRRState(1)
+	for i := 0; i < rebalanceEvery; i++ {
+		s.update(0, time.Second, true)
+	}
+	if w := s.effectiveWeightOf(0); w < 1 {
+		t.Fatalf("expected effective weight to be clamped at a minimum of 1, got %d", w)
+	}
+}
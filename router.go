@@ -5,6 +5,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -21,6 +22,9 @@ import (
 	"github.com/hashicorp/golang-lru"
 	"github.com/nu7hatch/gouuid"
 	"github.com/tsuru/planb/backend"
+	"github.com/tsuru/planb/healthcheck"
+	"github.com/tsuru/planb/ratelimit"
+	"golang.org/x/net/http2"
 )
 
 type FixedReadCloser struct {
@@ -40,6 +44,22 @@ var (
 	noRouteResponseBody = &FixedReadCloser{value: []byte("no such route")}
 )
 
+// cancelTimerBody wraps a backend response body so the request's timeout
+// context stays alive until the body is fully read and closed by
+// ReverseProxy's copy loop, rather than being cancelled the instant
+// RoundTripWithData returns. Cancelling any earlier truncates every
+// response body larger than what Transport.RoundTrip already buffered.
+type cancelTimerBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelTimerBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
 type requestData struct {
 	backendLen int
 	backend    string
@@ -48,6 +68,17 @@ type requestData struct {
 	host       string
 	debug      bool
 	startTime  time.Time
+	// stickyRefresh is set when the backend was chosen by the round-robin
+	// path (no valid affinity cookie was present) and a fresh cookie
+	// should be set on the response.
+	stickyRefresh bool
+	// swrr is set when the backend was chosen by the weighted rebalancer,
+	// so RoundTripWithData can feed the outcome back into its EWMAs.
+	swrr *swrrState
+	// breaker, when non-nil, is the circuit breaker guarding this
+	// frontend; RoundTripWithData consults it before dialing the backend
+	// and records the outcome back into it afterwards.
+	breaker *frontendBreaker
 }
 
 func (r *requestData) String() string {
@@ -76,24 +107,38 @@ func (p *bufferPool) Put(b []byte) {
 
 type Router struct {
 	http.Transport
-	ReadRedisHost   string
-	ReadRedisPort   int
-	WriteRedisHost  string
-	WriteRedisPort  int
-	LogPath         string
-	DialTimeout     time.Duration
-	RequestTimeout  time.Duration
-	DeadBackendTTL  int
-	FlushInterval   time.Duration
-	RequestIDHeader string
-	rp              *httputil.ReverseProxy
-	dialer          *net.Dialer
-	backend         backend.RoutesBackend
-	logger          *Logger
-	rrMutex         sync.RWMutex
-	roundRobin      map[string]*int32
-	cache           *lru.Cache
-	markingDisabled bool
+	ReadRedisHost          string
+	ReadRedisPort          int
+	WriteRedisHost         string
+	WriteRedisPort         int
+	LogPath                string
+	DialTimeout            time.Duration
+	RequestTimeout         time.Duration
+	DeadBackendTTL         int
+	FlushInterval          time.Duration
+	RequestIDHeader        string
+	Sticky                 StickyOptions
+	WeightedBackends       bool
+	RateLimitSize          int
+	HealthCheckEnabled     bool
+	HealthCheckConcurrency int
+	EnableHTTP2Backends    bool
+	rp                     *httputil.ReverseProxy
+	dialer                 *net.Dialer
+	backend                backend.RoutesBackend
+	logger                 *Logger
+	rrMutex                sync.RWMutex
+	roundRobin             map[string]*int32
+	swrrMutex              sync.RWMutex
+	swrr                   map[string]*swrrState
+	breakerMutex           sync.RWMutex
+	breakers               map[string]*frontendBreaker
+	rateLimiter            *ratelimit.Limiter
+	rateLimitMutex         sync.RWMutex
+	rateLimitConfigs       map[string]*backend.RateLimitConfig
+	healthChecker          *healthcheck.Checker
+	cache                  *lru.Cache
+	markingDisabled        bool
 }
 
 func (router *Router) Init() error {
@@ -130,9 +175,26 @@ func (router *Router) Init() error {
 	router.Transport = http.Transport{
 		Dial:                router.dialer.Dial,
 		TLSHandshakeTimeout: router.DialTimeout,
-		MaxIdleConnsPerHost: 100,
+		MaxIdleConnsPerHost: 200,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	if router.EnableHTTP2Backends {
+		if err = http2.ConfigureTransport(&router.Transport); err != nil {
+			return err
+		}
 	}
 	router.roundRobin = make(map[string]*int32)
+	router.swrr = make(map[string]*swrrState)
+	router.breakers = make(map[string]*frontendBreaker)
+	if router.RateLimitSize == 0 {
+		router.RateLimitSize = 100000
+	}
+	router.rateLimiter, err = ratelimit.NewLimiter(router.RateLimitSize)
+	if err != nil {
+		return err
+	}
+	router.rateLimitConfigs = make(map[string]*backend.RateLimitConfig)
+	router.startHealthChecker()
 	router.rp = &httputil.ReverseProxy{
 		Director:      func(*http.Request) {},
 		Transport:     router,
@@ -146,12 +208,16 @@ func (router *Router) Stop() {
 	if router.logger != nil {
 		router.logger.Stop()
 	}
+	if router.healthChecker != nil {
+		router.healthChecker.Stop()
+	}
 }
 
 type backendSet struct {
 	id       string
 	backends []string
 	dead     map[int]struct{}
+	sticky   bool
 	expires  time.Time
 }
 
@@ -168,7 +234,7 @@ func (router *Router) getBackends(host string) (*backendSet, error) {
 	}
 	var set backendSet
 	var err error
-	set.id, set.backends, set.dead, err = router.backend.Backends(host)
+	set.id, set.backends, set.dead, set.sticky, err = router.backend.Backends(host)
 	if err != nil {
 		return nil, fmt.Errorf("error running routes backend commands: %s", err)
 	}
@@ -177,6 +243,127 @@ func (router *Router) getBackends(host string) (*backendSet, error) {
 	return &set, nil
 }
 
+// getSWRRState returns the smooth weighted round-robin state for host,
+// creating or resizing it if the backend list grew or shrank since the
+// last request.
+func (router *Router) getSWRRState(host string, backendLen int) *swrrState {
+	router.swrrMutex.RLock()
+	state := router.swrr[host]
+	router.swrrMutex.RUnlock()
+	if state != nil && len(state.weights) == backendLen {
+		return state
+	}
+	router.swrrMutex.Lock()
+	defer router.swrrMutex.Unlock()
+	state = router.swrr[host]
+	if state == nil || len(state.weights) != backendLen {
+		state = newSWRRState(backendLen)
+		router.swrr[host] = state
+	}
+	return state
+}
+
+// getBreaker returns the circuit breaker for host, lazily creating it from
+// the per-frontend config stored in the routes backend. A host with no
+// breaker configuration returns a nil breaker and no error.
+func (router *Router) getBreaker(host string) (*frontendBreaker, error) {
+	router.breakerMutex.RLock()
+	breaker := router.breakers[host]
+	router.breakerMutex.RUnlock()
+	if breaker != nil {
+		return breaker, nil
+	}
+	config, ok, err := router.backend.BreakerConfig(host)
+	if err != nil {
+		return nil, fmt.Errorf("error running routes backend commands: %s", err)
+	}
+	if !ok {
+		return nil, nil
+	}
+	breaker, err = newFrontendBreaker(config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid circuit breaker predicate for %s: %s", host, err)
+	}
+	router.breakerMutex.Lock()
+	router.breakers[host] = breaker
+	router.breakerMutex.Unlock()
+	return breaker, nil
+}
+
+// getRateLimitConfig returns the rate limit config for host, lazily
+// creating it from the routes backend. A host with no rate limit
+// configuration returns a nil config and no error.
+func (router *Router) getRateLimitConfig(host string) (*backend.RateLimitConfig, error) {
+	router.rateLimitMutex.RLock()
+	config := router.rateLimitConfigs[host]
+	router.rateLimitMutex.RUnlock()
+	if config != nil {
+		return config, nil
+	}
+	fetched, ok, err := router.backend.RateLimitConfig(host)
+	if err != nil {
+		return nil, fmt.Errorf("error running routes backend commands: %s", err)
+	}
+	if !ok {
+		return nil, nil
+	}
+	config = &fetched
+	router.rateLimitMutex.Lock()
+	router.rateLimitConfigs[host] = config
+	router.rateLimitMutex.Unlock()
+	return config, nil
+}
+
+func (router *Router) clientIP(req *http.Request, config *backend.RateLimitConfig) string {
+	if config.TrustForwardedFor {
+		if xff := req.Header.Get("X-Forwarded-For"); xff != "" {
+			return strings.TrimSpace(strings.SplitN(xff, ",", 2)[0])
+		}
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// rateLimitKey builds the token bucket key for req under config. Limiter
+// is a single instance shared by every frontend, so the key is always
+// prefixed with host: without it, two frontends whose clients share an
+// IP or header value would collide on one bucket and rate-limit each
+// other using whichever frontend's config happened to call Allow first.
+func (router *Router) rateLimitKey(host string, req *http.Request, config *backend.RateLimitConfig) string {
+	switch config.KeySource {
+	case backend.RateLimitKeyHeader:
+		return host + "|h:" + req.Header.Get(config.HeaderName)
+	case backend.RateLimitKeyIPAndHeader:
+		return host + "|ih:" + router.clientIP(req, config) + "|" + req.Header.Get(config.HeaderName)
+	default:
+		return host + "|ip:" + router.clientIP(req, config)
+	}
+}
+
+// checkRateLimit applies the per-frontend token bucket, if one is
+// configured for req's host. Errors loading the config fail open: a
+// misconfigured or unreachable routes backend must not take frontends
+// down entirely.
+func (router *Router) checkRateLimit(req *http.Request) (limited bool, result ratelimit.Result) {
+	host, _, _ := net.SplitHostPort(req.Host)
+	if host == "" {
+		host = req.Host
+	}
+	config, err := router.getRateLimitConfig(host)
+	if err != nil {
+		logError(host, req.URL.Path, fmt.Errorf("error loading rate limit config: %s", err))
+		return false, result
+	}
+	if config == nil {
+		return false, result
+	}
+	result = router.rateLimiter.Allow(router.rateLimitKey(host, req, config), config.Rate, config.Burst)
+	return !result.Allowed, result
+}
+
 func (router *Router) getRequestData(req *http.Request, save bool) (*requestData, error) {
 	host, _, _ := net.SplitHostPort(req.Host)
 	if host == "" {
@@ -194,6 +381,33 @@ func (router *Router) getRequestData(req *http.Request, save bool) (*requestData
 	}
 	reqData.backendKey = set.id
 	reqData.backendLen = len(set.backends)
+	if set.sticky && router.Sticky.enabled() {
+		if cookie, err := req.Cookie(router.Sticky.CookieName); err == nil {
+			if backendURL, ok := router.Sticky.verify(cookie.Value); ok {
+				if idx := indexOfBackend(set.backends, backendURL); idx != -1 {
+					if _, isDead := set.dead[idx]; !isDead {
+						reqData.backendIdx = idx
+						reqData.backend = backendURL
+						return reqData, nil
+					}
+				}
+			}
+		}
+	}
+	if router.WeightedBackends {
+		state := router.getSWRRState(host, reqData.backendLen)
+		chosen := state.pick(set.dead)
+		if chosen == -1 {
+			return reqData, errors.New("all backends are dead")
+		}
+		reqData.backendIdx = chosen
+		reqData.backend = set.backends[chosen]
+		reqData.swrr = state
+		if set.sticky && router.Sticky.enabled() {
+			reqData.stickyRefresh = true
+		}
+		return reqData, nil
+	}
 	router.rrMutex.RLock()
 	roundRobin := router.roundRobin[host]
 	if roundRobin == nil {
@@ -228,6 +442,9 @@ func (router *Router) getRequestData(req *http.Request, save bool) (*requestData
 	}
 	reqData.backendIdx = toUseNumber
 	reqData.backend = set.backends[toUseNumber]
+	if set.sticky && router.Sticky.enabled() {
+		reqData.stickyRefresh = true
+	}
 	return reqData, nil
 }
 
@@ -281,14 +498,24 @@ func (router *Router) RoundTripWithData(req *http.Request, reqData *requestData)
 			ContentLength: int64(len(noRouteResponseBody.value)),
 			Body:          noRouteResponseBody,
 		}
+	} else if breaker, berr := router.getBreaker(reqData.host); berr != nil {
+		logError(reqData.String(), req.URL.Path, fmt.Errorf("error loading circuit breaker config: %s", berr))
+		rsp = &http.Response{
+			Request:    req,
+			StatusCode: http.StatusServiceUnavailable,
+			ProtoMajor: req.ProtoMajor,
+			ProtoMinor: req.ProtoMinor,
+			Header:     http.Header{},
+			Body:       emptyResponseBody,
+		}
+	} else if reqData.breaker = breaker; breaker != nil && !breaker.admit() {
+		rsp = breaker.fallbackResponse(req)
 	} else {
-		var timedout int32
+		var cancel context.CancelFunc
 		if router.RequestTimeout > 0 {
-			timer := time.AfterFunc(router.RequestTimeout, func() {
-				atomic.AddInt32(&timedout, 1)
-				router.Transport.CancelRequest(req)
-			})
-			defer timer.Stop()
+			var ctx context.Context
+			ctx, cancel = context.WithTimeout(req.Context(), router.RequestTimeout)
+			req = req.WithContext(ctx)
 		}
 		host, _, _ := net.SplitHostPort(req.URL.Host)
 		if host == "" {
@@ -307,7 +534,7 @@ func (router *Router) RoundTripWithData(req *http.Request, reqData *requestData)
 			if netErr, ok := err.(net.Error); ok {
 				markAsDead = !netErr.Temporary()
 			}
-			isTimeout := atomic.LoadInt32(&timedout) == int32(1)
+			isTimeout := errors.Is(req.Context().Err(), context.DeadlineExceeded)
 			if isTimeout {
 				markAsDead = false
 				err = fmt.Errorf("request timed out after %v: %s", router.RequestTimeout, err)
@@ -333,11 +560,33 @@ func (router *Router) RoundTripWithData(req *http.Request, reqData *requestData)
 				Body:       emptyResponseBody,
 			}
 		}
+		if cancel != nil {
+			if err != nil {
+				// No body will ever be read, so nothing defers the
+				// cancel for us; do it now instead of leaking the timer.
+				cancel()
+			} else {
+				rsp.Body = &cancelTimerBody{ReadCloser: rsp.Body, cancel: cancel}
+			}
+		}
+		if reqData.breaker != nil {
+			reqData.breaker.record(backendDuration, rsp.StatusCode, err != nil)
+		}
+	}
+	if reqData.swrr != nil {
+		reqData.swrr.update(reqData.backendIdx, backendDuration, err != nil || rsp.StatusCode >= 500)
 	}
+	router.applyStickyCookie(reqData, rsp)
 	if reqData.debug {
 		rsp.Header.Set("X-Debug-Backend-Url", reqData.backend)
 		rsp.Header.Set("X-Debug-Backend-Id", strconv.FormatUint(uint64(reqData.backendIdx), 10))
 		rsp.Header.Set("X-Debug-Frontend-Key", reqData.host)
+		if reqData.swrr != nil {
+			rsp.Header.Set("X-Debug-Backend-Weight", strconv.Itoa(reqData.swrr.effectiveWeightOf(reqData.backendIdx)))
+		}
+		if reqData.breaker != nil {
+			rsp.Header.Set("X-Debug-Breaker-State", reqData.breaker.getState().String())
+		}
 	}
 	if router.logger != nil {
 		router.logger.MessageRaw(&logEntry{
@@ -353,6 +602,10 @@ func (router *Router) RoundTripWithData(req *http.Request, reqData *requestData)
 }
 
 func (router *Router) serveWebsocket(rw http.ResponseWriter, req *http.Request) (*requestData, error) {
+	// getRequestData already honors an incoming affinity cookie, so an
+	// upgraded connection lands on the same backend as prior HTTP
+	// requests. We can't set a fresh cookie here: once hijacked, the
+	// response bytes belong to the backend, not to us.
 	reqData, err := router.getRequestData(req, false)
 	if err != nil {
 		return reqData, err
@@ -403,6 +656,18 @@ func (router *Router) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		rw.Write([]byte("OK"))
 		return
 	}
+	if req.Host == "__healthcheck__" && req.URL.Path == "/" {
+		router.serveHealthCheckStatus(rw)
+		return
+	}
+	if limited, result := router.checkRateLimit(req); limited {
+		rw.Header().Set("Retry-After", strconv.Itoa(int(result.RetryAfter/time.Second)+1))
+		rw.Header().Set("X-RateLimit-Limit", strconv.Itoa(int(result.Limit)))
+		rw.Header().Set("X-RateLimit-Remaining", strconv.Itoa(int(result.Remaining)))
+		rw.WriteHeader(http.StatusTooManyRequests)
+		rw.Write([]byte("rate limit exceeded"))
+		return
+	}
 	upgrade := req.Header.Get("Upgrade")
 	if upgrade != "" && strings.ToLower(upgrade) == "websocket" {
 		reqData, err := router.serveWebsocket(rw, req)
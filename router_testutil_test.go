@@ -0,0 +1,69 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/hashicorp/golang-lru"
+	"github.com/tsuru/planb/backend"
+	"github.com/tsuru/planb/healthcheck"
+)
+
+// fakeRoutesBackend is a minimal stand-in for backend.RoutesBackend, good
+// enough to exercise Router's selection and marking logic without a real
+// Redis-backed routes store.
+type fakeRoutesBackend struct {
+	backends []string
+	dead     map[int]struct{}
+	sticky   bool
+
+	breaker      backend.BreakerConfig
+	hasBreaker   bool
+	rateLimit    backend.RateLimitConfig
+	hasRateLimit bool
+}
+
+func (f *fakeRoutesBackend) Backends(host string) (string, []string, map[int]struct{}, bool, error) {
+	return host, f.backends, f.dead, f.sticky, nil
+}
+
+func (f *fakeRoutesBackend) MarkDead(host, backend string, backendIdx, backendLen int, ttl int) error {
+	if f.dead == nil {
+		f.dead = map[int]struct{}{}
+	}
+	f.dead[backendIdx] = struct{}{}
+	return nil
+}
+
+func (f *fakeRoutesBackend) MarkAlive(host, backend string, backendIdx, backendLen int) error {
+	delete(f.dead, backendIdx)
+	return nil
+}
+
+func (f *fakeRoutesBackend) BreakerConfig(host string) (backend.BreakerConfig, bool, error) {
+	return f.breaker, f.hasBreaker, nil
+}
+
+func (f *fakeRoutesBackend) RateLimitConfig(host string) (backend.RateLimitConfig, bool, error) {
+	return f.rateLimit, f.hasRateLimit, nil
+}
+
+func (f *fakeRoutesBackend) AllFrontends() ([]string, error) {
+	return nil, nil
+}
+
+func (f *fakeRoutesBackend) HealthCheckConfig(host string) (healthcheck.Config, bool, error) {
+	return healthcheck.Config{}, false, nil
+}
+
+func newTestLRU(tb testing.TB) *lru.Cache {
+	tb.Helper()
+	cache, err := lru.New(100)
+	if err != nil {
+		tb.Fatalf("unexpected error creating test cache: %s", err)
+	}
+	return cache
+}
@@ -0,0 +1,117 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestRoundTripWithDataTimesOutAgainstHTTP2Backend exercises the
+// context.WithTimeout path added to RoundTripWithData against a real
+// HTTP/2 backend, proving the request is actually cancelled rather than
+// left to run to completion.
+func TestRoundTripWithDataTimesOutAgainstHTTP2Backend(t *testing.T) {
+	handlerStarted := make(chan struct{}, 1)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlerStarted <- struct{}{}
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("too late"))
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	backendURL, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatalf("unexpected error parsing test server url: %s", err)
+	}
+
+	dialer := &net.Dialer{}
+	router := &Router{
+		RequestTimeout: 20 * time.Millisecond,
+		backend:        &fakeRoutesBackend{},
+		dialer:         dialer,
+	}
+	router.Transport = http.Transport{
+		Dial:            dialer.Dial,
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		// A custom Dial or TLSClientConfig disables automatic HTTP/2.
+		ForceAttemptHTTP2: true,
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "https://frontend.example.com/slow", nil)
+	req.URL.Scheme = backendURL.Scheme
+	req.URL.Host = backendURL.Host
+
+	reqData := &requestData{host: "frontend.example.com", backend: srv.URL, startTime: time.Now()}
+
+	start := time.Now()
+	rsp := router.RoundTripWithData(req, reqData)
+	elapsed := time.Since(start)
+
+	select {
+	case <-handlerStarted:
+	default:
+		t.Fatalf("expected the slow backend handler to have actually started")
+	}
+	if rsp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected a 503 once the context deadline fires, got %d", rsp.StatusCode)
+	}
+	if elapsed > 150*time.Millisecond {
+		t.Fatalf("expected the request to be cancelled around RequestTimeout (20ms), took %s instead of waiting the full 200ms handler sleep", elapsed)
+	}
+}
+
+// TestRoundTripWithDataDoesNotTruncateBodyReadAfterReturn proves
+// RoundTripWithData no longer cancels the request context the instant it
+// returns: the body must still be fully readable afterwards, the way
+// httputil.ReverseProxy's copy loop reads it, well past RequestTimeout.
+func TestRoundTripWithDataDoesNotTruncateBodyReadAfterReturn(t *testing.T) {
+	body := strings.Repeat("x", 1<<20)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	backendURL, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatalf("unexpected error parsing test server url: %s", err)
+	}
+
+	dialer := &net.Dialer{}
+	router := &Router{
+		RequestTimeout: 20 * time.Millisecond,
+		backend:        &fakeRoutesBackend{},
+		dialer:         dialer,
+	}
+	router.Transport = http.Transport{Dial: dialer.Dial}
+
+	req := httptest.NewRequest(http.MethodGet, "http://frontend.example.com/", nil)
+	req.URL.Scheme = backendURL.Scheme
+	req.URL.Host = backendURL.Host
+
+	reqData := &requestData{host: "frontend.example.com", backend: srv.URL, startTime: time.Now()}
+
+	rsp := router.RoundTripWithData(req, reqData)
+	defer rsp.Body.Close()
+
+	time.Sleep(50 * time.Millisecond) // well past RequestTimeout
+
+	got, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		t.Fatalf("expected the body to still be readable after RequestTimeout elapsed, got error: %s", err)
+	}
+	if string(got) != body {
+		t.Fatalf("expected the full %d-byte body, got %d bytes", len(body), len(got))
+	}
+}
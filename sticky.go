@@ -0,0 +1,89 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strings"
+)
+
+// StickyOptions configures cookie-based backend affinity. It is shared by
+// every frontend that enables sticky sessions; the per-frontend opt-in
+// itself lives alongside the backends list in the routes backend.
+type StickyOptions struct {
+	CookieName string
+	HMACKey    []byte
+	Secure     bool
+	HttpOnly   bool
+	SameSite   http.SameSite
+}
+
+func (o *StickyOptions) enabled() bool {
+	return o != nil && o.CookieName != "" && len(o.HMACKey) > 0
+}
+
+// sign returns an opaque cookie value binding backendURL to this key, so
+// that a backend-list reshuffle can't make an old cookie point somewhere
+// else: the URL itself is signed, not its (unstable) index.
+func (o *StickyOptions) sign(backendURL string) string {
+	mac := hmac.New(sha256.New, o.HMACKey)
+	mac.Write([]byte(backendURL))
+	sig := base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	return base64.RawURLEncoding.EncodeToString([]byte(backendURL)) + "." + sig
+}
+
+// verify checks the HMAC and returns the backend URL it signs. It rejects
+// tampered or malformed cookies.
+func (o *StickyOptions) verify(cookieValue string) (string, bool) {
+	parts := strings.SplitN(cookieValue, ".", 2)
+	if len(parts) != 2 {
+		return "", false
+	}
+	rawURL, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", false
+	}
+	expected := o.sign(string(rawURL))
+	if !hmac.Equal([]byte(expected), []byte(cookieValue)) {
+		return "", false
+	}
+	return string(rawURL), true
+}
+
+func (o *StickyOptions) cookie(backendURL string) *http.Cookie {
+	return &http.Cookie{
+		Name:     o.CookieName,
+		Value:    o.sign(backendURL),
+		Path:     "/",
+		Secure:   o.Secure,
+		HttpOnly: o.HttpOnly,
+		SameSite: o.SameSite,
+	}
+}
+
+func indexOfBackend(backends []string, backendURL string) int {
+	for i, b := range backends {
+		if b == backendURL {
+			return i
+		}
+	}
+	return -1
+}
+
+// applyStickyCookie is the post-RoundTrip hook that sets the affinity
+// cookie on the response whenever the request picked (or re-picked) a
+// backend through the round-robin path rather than an existing cookie.
+func (router *Router) applyStickyCookie(reqData *requestData, rsp *http.Response) {
+	if !reqData.stickyRefresh || !router.Sticky.enabled() || reqData.backend == "" {
+		return
+	}
+	if rsp.Header == nil {
+		rsp.Header = http.Header{}
+	}
+	rsp.Header.Add("Set-Cookie", router.Sticky.cookie(reqData.backend).String())
+}
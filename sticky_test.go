@@ -0,0 +1,192 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func testStickyOptions() StickyOptions {
+	return StickyOptions{
+		CookieName: "PLANB_AFFINITY",
+		HMACKey:    []byte("super-secret-key"),
+		Secure:     true,
+		HttpOnly:   true,
+	}
+}
+
+func TestStickySignVerifyRoundTrip(t *testing.T) {
+	opts := testStickyOptions()
+	value := opts.sign("http://10.0.0.1:8080")
+	backendURL, ok := opts.verify(value)
+	if !ok {
+		t.Fatalf("expected signed value to verify")
+	}
+	if backendURL != "http://10.0.0.1:8080" {
+		t.Fatalf("expected backend url to round-trip, got %q", backendURL)
+	}
+}
+
+func TestStickyVerifyRejectsTampering(t *testing.T) {
+	opts := testStickyOptions()
+	value := opts.sign("http://10.0.0.1:8080")
+	tampered := value[:len(value)-1] + "x"
+	if _, ok := opts.verify(tampered); ok {
+		t.Fatalf("expected tampered cookie to be rejected")
+	}
+	otherKey := StickyOptions{CookieName: opts.CookieName, HMACKey: []byte("different-key")}
+	if _, ok := otherKey.verify(value); ok {
+		t.Fatalf("expected cookie signed with a different key to be rejected")
+	}
+	if _, ok := opts.verify("not-even-close-to-valid"); ok {
+		t.Fatalf("expected malformed cookie to be rejected")
+	}
+}
+
+func TestIndexOfBackendRotation(t *testing.T) {
+	backends := []string{"http://a", "http://b", "http://c"}
+	if idx := indexOfBackend(backends, "http://b"); idx != 1 {
+		t.Fatalf("expected index 1, got %d", idx)
+	}
+	// Simulates a reshuffle: the previously sticky backend is gone, so the
+	// cookie no longer maps to any live index and the caller must fall
+	// back to round-robin.
+	if idx := indexOfBackend(backends, "http://gone"); idx != -1 {
+		t.Fatalf("expected -1 for a backend no longer in the list, got %d", idx)
+	}
+}
+
+func TestGetRequestDataStickyCookieWinsUnlessDead(t *testing.T) {
+	opts := testStickyOptions()
+	backends := []string{"http://a", "http://b", "http://c"}
+
+	router := &Router{Sticky: opts, backend: &fakeRoutesBackend{backends: backends, sticky: true}, cache: newTestLRU(t)}
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.AddCookie(&http.Cookie{Name: opts.CookieName, Value: opts.sign("http://b")})
+	reqData, err := router.getRequestData(req, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if reqData.backend != "http://b" {
+		t.Fatalf("expected sticky backend http://b, got %s", reqData.backend)
+	}
+	if reqData.stickyRefresh {
+		t.Fatalf("an existing valid cookie should not be refreshed")
+	}
+}
+
+func TestGetRequestDataFallsBackWhenStickyBackendIsDead(t *testing.T) {
+	opts := testStickyOptions()
+	backends := []string{"http://a", "http://b", "http://c"}
+
+	router := &Router{
+		Sticky:     opts,
+		backend:    &fakeRoutesBackend{backends: backends, dead: map[int]struct{}{1: {}}, sticky: true},
+		cache:      newTestLRU(t),
+		roundRobin: make(map[string]*int32),
+	}
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.AddCookie(&http.Cookie{Name: opts.CookieName, Value: opts.sign("http://b")})
+	reqData, err := router.getRequestData(req, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if reqData.backend == "http://b" {
+		t.Fatalf("expected fallback away from the dead sticky backend")
+	}
+	if !reqData.stickyRefresh {
+		t.Fatalf("expected a fresh cookie to be issued after falling back")
+	}
+}
+
+func TestGetRequestDataAllBackendsDeadIsAnError(t *testing.T) {
+	router := &Router{
+		backend:    &fakeRoutesBackend{backends: []string{"http://a"}, dead: map[int]struct{}{0: {}}},
+		cache:      newTestLRU(t),
+		roundRobin: make(map[string]*int32),
+	}
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	if _, err := router.getRequestData(req, false); err == nil {
+		t.Fatalf("expected an error when every backend is dead")
+	}
+}
+
+// pipeHijacker implements http.ResponseWriter and http.Hijacker over a
+// net.Pipe, so serveWebsocket's hijack-then-copy path can be exercised
+// without a real listening socket on the client side. The client end is
+// drained so the backend's bytes can be copied through the unbuffered pipe.
+type pipeHijacker struct {
+	header http.Header
+	client net.Conn
+}
+
+func (p *pipeHijacker) Header() http.Header         { return p.header }
+func (p *pipeHijacker) Write(b []byte) (int, error) { return len(b), nil }
+func (p *pipeHijacker) WriteHeader(int)             {}
+
+func (p *pipeHijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	server, client := net.Pipe()
+	p.client = client
+	go io.Copy(io.Discard, client)
+	brw := bufio.NewReadWriter(bufio.NewReader(server), bufio.NewWriter(server))
+	return server, brw, nil
+}
+
+func TestServeWebsocketDialsStickyBackendHostPort(t *testing.T) {
+	backendLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error starting fake backend: %s", err)
+	}
+	defer backendLn.Close()
+
+	accepted := make(chan string, 1)
+	go func() {
+		conn, err := backendLn.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		requestLine, _ := reader.ReadString('\n')
+		accepted <- requestLine
+		conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"))
+	}()
+
+	backendURL := "http://" + backendLn.Addr().String()
+	opts := testStickyOptions()
+	router := &Router{
+		Sticky:  opts,
+		backend: &fakeRoutesBackend{backends: []string{backendURL}, sticky: true},
+		cache:   newTestLRU(t),
+		dialer:  &net.Dialer{},
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/socket", nil)
+	req.AddCookie(&http.Cookie{Name: opts.CookieName, Value: opts.sign(backendURL)})
+	req.Header.Set("Upgrade", "websocket")
+	req.RemoteAddr = "10.0.0.5:54321"
+
+	rw := &pipeHijacker{header: http.Header{}}
+	reqData, err := router.serveWebsocket(rw, req)
+	if err != nil {
+		t.Fatalf("serveWebsocket returned error: %s", err)
+	}
+	if reqData.backend != backendURL {
+		t.Fatalf("expected the sticky-cookie backend %s to be dialed, got %s", backendURL, reqData.backend)
+	}
+	select {
+	case line := <-accepted:
+		if line == "" {
+			t.Fatalf("expected the backend to receive a request line")
+		}
+	default:
+		t.Fatalf("expected the backend to have accepted a connection")
+	}
+}